@@ -0,0 +1,363 @@
+package fetchmgr
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Entry is a value stored in a Cache, together with enough information for
+// CachedFetcher to serve it back to callers without calling Fetcher again.
+type Entry struct {
+	// Value is the fetched value. Unused when Err != nil.
+	Value interface{}
+	// Err is the error returned by Fetcher.Fetch, for an entry that
+	// memoizes a failure (see Options.NegativeTTL).
+	Err error
+	// Negative marks an entry that memoizes a failed fetch rather than a
+	// fetched value, so it can be told apart in Stats.
+	Negative bool
+}
+
+// Cache is a storage backend for CachedFetcher. CachedFetcher coalesces
+// concurrent fetches for the same key itself and only calls into Cache
+// with already-resolved values, so a Cache implementation just needs to
+// store and expire them -- it can be backed by Redis, memcached, BoltDB or
+// similar to share or persist results beyond a single process.
+type Cache interface {
+	// Get returns the entry stored for key, if any and not yet expired.
+	Get(key interface{}) (Entry, bool)
+	// Set stores e for key, to expire after ttl.
+	Set(key interface{}, e Entry, ttl time.Duration)
+	// Delete removes key, if present.
+	Delete(key interface{})
+	// Len returns the number of entries currently stored.
+	Len() int
+}
+
+// Stats reports cache effectiveness counters, as returned by
+// MemoryCache.Stats.
+type Stats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+
+	// NegativeHits counts the subset of Hits served from a memoized error
+	// (see Options.NegativeTTL), rather than a memoized value.
+	NegativeHits int64
+}
+
+// MemoryCacheOptions bounds the size of a MemoryCache.
+type MemoryCacheOptions struct {
+	// MaxEntries caps the number of cached entries. When non-zero, an
+	// insertion that would grow the cache beyond this limit evicts the
+	// least recently used entry first.
+	MaxEntries int
+
+	// MaxBytes caps the total size of cached values, as measured by Sizer.
+	// It has no effect unless Sizer is also set. The most recently inserted
+	// entry is never evicted to meet it, so a single value larger than
+	// MaxBytes stays cached as the only entry.
+	MaxBytes int64
+
+	// Sizer measures the size, in bytes, of a cached value. Required to
+	// use MaxBytes.
+	Sizer func(value interface{}) int64
+}
+
+// cacheItem is the stored state for a single key: its entry, its position
+// in the LRU list, and its position (if any) in the expiry heap.
+type cacheItem struct {
+	entry    Entry
+	lruEl    *list.Element
+	size     int64
+	heapItem *deleteItem
+}
+
+// MemoryCache is the default, in-process Cache: a map guarded by a mutex,
+// with keys expired off a TTL heap by a background goroutine and,
+// optionally, bounded to a maximum size via an LRU policy. A single mutex
+// guards both the map and the heap, so eviction (LRU or TTL) can always
+// keep them in sync instead of leaving stale heap entries to be discovered
+// later.
+type MemoryCache struct {
+	mutex      sync.Mutex
+	data       map[interface{}]*cacheItem
+	lru        *list.List
+	maxEntries int
+	maxBytes   int64
+	totalBytes int64
+	sizer      func(value interface{}) int64
+	stats      Stats
+	queue      deleteQueue
+
+	wake      chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryCache creates an unbounded MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return NewMemoryCacheWithOptions(MemoryCacheOptions{})
+}
+
+// NewMemoryCacheWithOptions creates a MemoryCache bounded as described by
+// opts. A zero MemoryCacheOptions behaves like NewMemoryCache.
+func NewMemoryCacheWithOptions(opts MemoryCacheOptions) *MemoryCache {
+	mc := &MemoryCache{
+		data:       make(map[interface{}]*cacheItem),
+		lru:        list.New(),
+		maxEntries: opts.MaxEntries,
+		maxBytes:   opts.MaxBytes,
+		sizer:      opts.Sizer,
+		wake:       make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+	}
+
+	go mc.deleteLoop()
+
+	return mc
+}
+
+// Close stops the background eviction goroutine. It is safe to call Close
+// more than once.
+func (mc *MemoryCache) Close() error {
+	mc.closeOnce.Do(func() {
+		close(mc.closing)
+	})
+	return nil
+}
+
+// Stats returns a snapshot of the cache's hit/miss/eviction counters,
+// useful for tuning MemoryCacheOptions.MaxEntries and MaxBytes.
+func (mc *MemoryCache) Stats() Stats {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	return mc.stats
+}
+
+// Get implements Cache.
+func (mc *MemoryCache) Get(key interface{}) (Entry, bool) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	item, ok := mc.data[key]
+	if !ok {
+		mc.stats.Misses++
+		return Entry{}, false
+	}
+
+	mc.stats.Hits++
+	if item.entry.Negative {
+		mc.stats.NegativeHits++
+	}
+	mc.lru.MoveToFront(item.lruEl)
+
+	return item.entry, true
+}
+
+// Set implements Cache.
+func (mc *MemoryCache) Set(key interface{}, e Entry, ttl time.Duration) {
+	var size int64
+	if mc.sizer != nil {
+		size = mc.sizer(e.Value)
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	item, ok := mc.data[key]
+	if ok {
+		mc.totalBytes += size - item.size
+		item.entry, item.size = e, size
+		mc.lru.MoveToFront(item.lruEl)
+	} else {
+		item = &cacheItem{entry: e, size: size}
+		item.lruEl = mc.lru.PushFront(key)
+		mc.data[key] = item
+		mc.totalBytes += size
+	}
+
+	mc.scheduleExpiry(key, item, ttl)
+
+	for mc.overCapacity() {
+		mc.evictBack()
+	}
+}
+
+// Delete implements Cache.
+func (mc *MemoryCache) Delete(key interface{}) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if item, ok := mc.data[key]; ok {
+		mc.removeItem(key, item)
+	}
+}
+
+// Len implements Cache.
+func (mc *MemoryCache) Len() int {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	return len(mc.data)
+}
+
+// overCapacity reports whether the cache is over its configured limits and
+// needs to evict. Callers must hold mc.mutex.
+func (mc *MemoryCache) overCapacity() bool {
+	if mc.lru.Len() <= 1 {
+		return false
+	}
+	if mc.maxEntries > 0 && mc.lru.Len() > mc.maxEntries {
+		return true
+	}
+	return mc.maxBytes > 0 && mc.sizer != nil && mc.totalBytes > mc.maxBytes
+}
+
+// evictBack evicts the least recently used entry, pruning its expiry-heap
+// entry along with it so the heap never outgrows data. Callers must hold
+// mc.mutex.
+func (mc *MemoryCache) evictBack() {
+	back := mc.lru.Back()
+	if back == nil {
+		return
+	}
+
+	key := back.Value
+	if evicted, ok := mc.data[key]; ok {
+		mc.removeItem(key, evicted)
+	}
+	mc.stats.Evictions++
+}
+
+// removeItem drops item from data, lru and the expiry heap. Callers must
+// hold mc.mutex.
+func (mc *MemoryCache) removeItem(key interface{}, item *cacheItem) {
+	delete(mc.data, key)
+	mc.totalBytes -= item.size
+	mc.lru.Remove(item.lruEl)
+	mc.cancelExpiry(item)
+}
+
+// scheduleExpiry replaces item's expiry-heap entry with one that fires
+// after ttl. Callers must hold mc.mutex.
+func (mc *MemoryCache) scheduleExpiry(key interface{}, item *cacheItem, ttl time.Duration) {
+	mc.cancelExpiry(item)
+
+	di := &deleteItem{key: key, expire: time.Now().Add(ttl), item: item}
+	item.heapItem = di
+	wakeLoop := mc.queue.Len() == 0 || di.expire.Before(mc.queue[0].expire)
+	heap.Push(&mc.queue, di)
+
+	if wakeLoop {
+		select {
+		case mc.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancelExpiry removes item's current expiry-heap entry, if it still has
+// one. Callers must hold mc.mutex.
+func (mc *MemoryCache) cancelExpiry(item *cacheItem) {
+	if item.heapItem == nil || item.heapItem.index < 0 {
+		return
+	}
+	heap.Remove(&mc.queue, item.heapItem.index)
+	item.heapItem = nil
+}
+
+// deleteLoop evicts expired keys as they come due. It sleeps on a timer set
+// to the next expiry instead of polling, and is woken early by
+// scheduleExpiry whenever an earlier expiry is queued. It returns once
+// Close is called.
+func (mc *MemoryCache) deleteLoop() {
+	timer := time.NewTimer(time.Hour)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	for {
+		mc.mutex.Lock()
+		now := time.Now()
+		for mc.queue.Len() > 0 && !mc.queue[0].expire.After(now) {
+			di := heap.Pop(&mc.queue).(*deleteItem)
+			// Belt-and-braces: scheduleExpiry/removeItem keep the heap in
+			// sync with data, so this should always match, but a mismatch
+			// is harmless to ignore rather than fatal.
+			if cur, ok := mc.data[di.key]; ok && cur == di.item {
+				mc.removeItem(di.key, cur)
+			}
+		}
+
+		var wait time.Duration
+		hasNext := mc.queue.Len() > 0
+		if hasNext {
+			wait = mc.queue[0].expire.Sub(now)
+		}
+		mc.mutex.Unlock()
+
+		if hasNext {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-mc.wake:
+				if !timer.Stop() {
+					<-timer.C
+				}
+			case <-mc.closing:
+				return
+			}
+		} else {
+			select {
+			case <-mc.wake:
+			case <-mc.closing:
+				return
+			}
+		}
+	}
+}
+
+// deleteItem is an entry in the expiry heap. index tracks its current
+// position so cancelExpiry can remove it directly via heap.Remove instead
+// of waiting for deleteLoop to pop and discard it.
+type deleteItem struct {
+	key    interface{}
+	expire time.Time
+	item   *cacheItem
+	index  int
+}
+
+type deleteQueue []*deleteItem
+
+func (dq deleteQueue) Len() int { return len(dq) }
+
+func (dq deleteQueue) Less(i, j int) bool {
+	return dq[i].expire.Before(dq[j].expire)
+}
+
+func (dq deleteQueue) Swap(i, j int) {
+	dq[i], dq[j] = dq[j], dq[i]
+	dq[i].index = i
+	dq[j].index = j
+}
+
+func (dq *deleteQueue) Push(x interface{}) {
+	di := x.(*deleteItem)
+	di.index = len(*dq)
+	*dq = append(*dq, di)
+}
+
+func (dq *deleteQueue) Pop() interface{} {
+	old := *dq
+	n := len(old)
+	di := old[n-1]
+	old[n-1] = nil
+	di.index = -1
+	*dq = old[:n-1]
+	return di
+}
@@ -0,0 +1,75 @@
+package fetchmgr
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMemoryCacheEvictsLeastRecentlyUsed guards against a regression where
+// LRU eviction dropped an entry from data/lru but left its expiry-heap
+// entry behind, letting the heap grow unbounded under a MaxEntries cache
+// with high key churn.
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	mc := NewMemoryCacheWithOptions(MemoryCacheOptions{MaxEntries: 2})
+	defer mc.Close()
+
+	mc.Set("a", Entry{Value: "a"}, time.Minute)
+	mc.Set("b", Entry{Value: "b"}, time.Minute)
+	mc.Set("c", Entry{Value: "c"}, time.Minute)
+
+	if got := mc.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+	if _, ok := mc.Get("a"); ok {
+		t.Fatal("Get(\"a\") found an entry, want it evicted as least recently used")
+	}
+	if _, ok := mc.Get("b"); !ok {
+		t.Fatal("Get(\"b\") found no entry, want it still cached")
+	}
+	if _, ok := mc.Get("c"); !ok {
+		t.Fatal("Get(\"c\") found no entry, want it still cached")
+	}
+
+	stats := mc.Stats()
+	if stats.Evictions != 1 {
+		t.Fatalf("Stats().Evictions = %d, want 1", stats.Evictions)
+	}
+	if stats.Hits != 2 {
+		t.Fatalf("Stats().Hits = %d, want 2", stats.Hits)
+	}
+	if stats.Misses != 1 {
+		t.Fatalf("Stats().Misses = %d, want 1", stats.Misses)
+	}
+
+	if l := mc.queue.Len(); l != 2 {
+		t.Fatalf("expiry heap has %d entries after eviction, want 2 (one per live key)", l)
+	}
+}
+
+// TestMemoryCacheCloseStopsDeleteLoop guards against a regression in
+// Close's background eviction goroutine: Close must close the closing
+// channel that deleteLoop returns on, and calling it more than once must
+// not panic or block.
+func TestMemoryCacheCloseStopsDeleteLoop(t *testing.T) {
+	mc := NewMemoryCache()
+
+	if err := mc.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	if err := mc.Close(); err != nil {
+		t.Fatalf("second Close() = %v, want nil", err)
+	}
+
+	select {
+	case <-mc.closing:
+	default:
+		t.Fatal("closing channel not closed after Close()")
+	}
+}
+
+// TestMemoryCacheImplementsCache is a compile-time-ish sanity check that
+// MemoryCache satisfies the pluggable Cache interface CachedFetcher is
+// built against.
+func TestMemoryCacheImplementsCache(t *testing.T) {
+	var _ Cache = NewMemoryCache()
+}
@@ -1,144 +1,244 @@
 package fetchmgr
 
 import (
-	"container/heap"
+	"context"
+	"fmt"
+	"io"
 	"sync"
 	"time"
 )
 
-// CachedFetcher caches fetched contents. It use Fetcher internally to fetch
-// resources. It will call Fetcher's Fetch method thread-safely.
+// CachedFetcher caches fetched contents. It uses Fetcher internally to
+// fetch resources, and a Cache to store results -- such as a
+// NewMemoryCache, but any Cache implementation can be plugged in to share
+// or persist results beyond a single process. CachedFetcher itself only
+// handles coalescing concurrent fetches for the same key; it never stores
+// in-flight state in the Cache.
+//
+// A CachedFetcher built with NewCachedFetcher uses a plain Fetcher and is
+// driven through Fetch. One built with NewCachedFetcherContext uses a
+// ContextFetcher instead and should be driven through FetchContext so that
+// callers can cancel a fetch or bound it with a deadline.
+//
+// Close releases the underlying Cache's resources (such as a MemoryCache's
+// background eviction goroutine) if it implements io.Closer, making
+// CachedFetcher satisfy FetchCloser so it can be wrapped with
+// NewSafeFetchCloser like any other FetchCloser.
 type CachedFetcher struct {
-	fetcher  Fetcher
-	ttl      time.Duration
+	fetcher        Fetcher
+	ctxFetcher     ContextFetcher
+	ttl            time.Duration
+	cache          Cache
+	negativeTTL    time.Duration
+	isCacheableErr func(error) bool
+
 	mutex    sync.Mutex
-	cache    map[interface{}]entry
-	queMutex sync.Mutex
-	queue    deleteQueue
+	inflight map[interface{}]*entry
 }
 
+// entry is the shared, in-flight state for a single key. All callers
+// coalesced onto the same fetch share the same entry and block on done,
+// which is closed exactly once the fetch (or a recovered panic) completes.
 type entry struct {
-	value func() (interface{}, error)
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// Options configures optional behavior of a CachedFetcher created via
+// NewCachedFetcherWithOptions.
+type Options struct {
+	// NegativeTTL, when non-zero, memoizes a failed fetch for that long
+	// instead of leaving every key miss to hit a failing upstream again.
+	// The error is returned to every coalesced waiter, same as an
+	// uncached error would be.
+	NegativeTTL time.Duration
+
+	// IsCacheableError decides whether an error returned by Fetcher.Fetch
+	// should be memoized for NegativeTTL. It defaults to caching every
+	// error. It is ignored unless NegativeTTL is set.
+	IsCacheableError func(error) bool
 }
 
-// NewCachedFetcher creates CachedFetcher
+// NewCachedFetcher creates a CachedFetcher that stores results in cache.
 func NewCachedFetcher(
 	fetcher Fetcher,
 	ttl time.Duration,
+	cache Cache,
 ) *CachedFetcher {
-	cached := &CachedFetcher{
-		fetcher: fetcher,
-		ttl:     ttl,
-		cache:   make(map[interface{}]entry),
+	return &CachedFetcher{
+		fetcher:  fetcher,
+		ttl:      ttl,
+		cache:    cache,
+		inflight: make(map[interface{}]*entry),
 	}
+}
 
-	go cached.deleteLoop()
+// NewCachedFetcherWithOptions creates a CachedFetcher like NewCachedFetcher,
+// additionally configured as described by opts. A zero Options behaves
+// like NewCachedFetcher.
+func NewCachedFetcherWithOptions(
+	fetcher Fetcher,
+	ttl time.Duration,
+	cache Cache,
+	opts Options,
+) *CachedFetcher {
+	return &CachedFetcher{
+		fetcher:        fetcher,
+		ttl:            ttl,
+		cache:          cache,
+		negativeTTL:    opts.NegativeTTL,
+		isCacheableErr: opts.IsCacheableError,
+		inflight:       make(map[interface{}]*entry),
+	}
+}
 
-	return cached
+// NewCachedFetcherContext creates a CachedFetcher backed by a
+// ContextFetcher, storing results in cache. Concurrent calls to
+// FetchContext for the same key are coalesced into a single upstream
+// fetch; see FetchContext for how cancellation is handled.
+func NewCachedFetcherContext(
+	fetcher ContextFetcher,
+	ttl time.Duration,
+	cache Cache,
+) *CachedFetcher {
+	return &CachedFetcher{
+		ctxFetcher: fetcher,
+		ttl:        ttl,
+		cache:      cache,
+		inflight:   make(map[interface{}]*entry),
+	}
+}
+
+// Close releases the underlying Cache's resources, if it implements
+// io.Closer. It is a no-op otherwise.
+func (c *CachedFetcher) Close() error {
+	if closer, ok := c.cache.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Stats returns the underlying Cache's effectiveness counters, if it
+// implements Stats() Stats (as MemoryCache does), or a zero Stats
+// otherwise.
+func (c *CachedFetcher) Stats() Stats {
+	if sc, ok := c.cache.(interface{ Stats() Stats }); ok {
+		return sc.Stats()
+	}
+	return Stats{}
 }
 
 // Fetch memoizes fetcher.Fetch method.
 // It calls fetcher.Fetch method and caches the return value unless there is no
 // cached results. Chached values are expired when c.ttl has passed.
 // If the internal Fetcher.Fetch returns err (!= nil), CachedFetcher doesn't
-// cache any results.
+// cache any results, unless Options.NegativeTTL was set.
 func (c *CachedFetcher) Fetch(key interface{}) (interface{}, error) {
-	e := pickEntry(c, key)
-	return e.value()
-}
-
-func pickEntry(c *CachedFetcher, key interface{}) entry {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	cached, ok := c.cache[key]
-	if ok {
-		return cached
+	if cached, ok := c.cache.Get(key); ok {
+		return cached.Value, cached.Err
 	}
 
-	var val interface{}
-	var err error
-	done := make(chan struct{})
-	go func() {
-		val, err = c.fetcher.Fetch(key)
-		close(done)
-
-		if err != nil {
-			// Don't reuse error values
-			c.queueKey(key, 0)
-			return
-		}
-
-		c.queueKey(key, c.ttl)
-	}()
+	e := pickEntry(c, context.Background(), key)
+	<-e.done
+	return e.value, e.err
+}
 
-	lazy := func() (interface{}, error) {
-		<-done
-		return val, err
+// FetchContext memoizes ctxFetcher.Fetch, coalescing concurrent calls for
+// the same key into a single upstream fetch the way Fetch does. The
+// upstream fetcher.Fetch call carries the values of whichever caller's
+// context triggered it, but not its cancellation: no single waiter's
+// context being canceled or timing out can abort the fetch for the other
+// waiters coalesced onto it. If ctx is canceled or its deadline passes
+// before the fetch completes, FetchContext still returns ctx.Err()
+// immediately to that caller, without affecting anyone else.
+func (c *CachedFetcher) FetchContext(ctx context.Context, key interface{}) (interface{}, error) {
+	if cached, ok := c.cache.Get(key); ok {
+		return cached.Value, cached.Err
 	}
 
-	cached = entry{value: lazy}
-	c.cache[key] = cached
-
-	return cached
+	e := pickEntry(c, ctx, key)
+	select {
+	case <-e.done:
+		return e.value, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (c *CachedFetcher) deleteKey(key interface{}) {
+func pickEntry(c *CachedFetcher, ctx context.Context, key interface{}) *entry {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	delete(c.cache, key)
-}
+	if cached, ok := c.cache.Get(key); ok {
+		// Resolved by another caller while we were waiting for the lock.
+		done := make(chan struct{})
+		close(done)
+		return &entry{done: done, value: cached.Value, err: cached.Err}
+	}
 
-func (c *CachedFetcher) queueKey(key interface{}, ttl time.Duration) {
-	c.queMutex.Lock()
-	defer c.queMutex.Unlock()
+	if e, ok := c.inflight[key]; ok {
+		return e
+	}
 
-	item := deleteItem{key, time.Now().Add(ttl)}
-	heap.Push(&c.queue, item)
-}
+	e := &entry{done: make(chan struct{})}
+	c.inflight[key] = e
 
-func (c *CachedFetcher) deleteLoop() {
-	for {
-		c.queMutex.Lock()
-		if c.queue.Len() > 0 {
-			item := heap.Pop(&c.queue).(deleteItem)
-			if item.expire.Before(time.Now()) {
-				c.deleteKey(item.key)
-			} else {
-				heap.Push(&c.queue, item)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				e.value = nil
+				e.err = fmt.Errorf("fetchmgr: recovered panic in Fetch: %v", r)
+				close(e.done)
+
+				c.mutex.Lock()
+				delete(c.inflight, key)
+				c.mutex.Unlock()
 			}
+		}()
+
+		if c.ctxFetcher != nil {
+			// detach: the upstream call must not be aborted just because
+			// the one waiter who happened to trigger it gave up; every
+			// other coalesced waiter still needs its result.
+			e.value, e.err = c.ctxFetcher.Fetch(detach(ctx), key)
+		} else {
+			e.value, e.err = c.fetcher.Fetch(key)
 		}
-		c.queMutex.Unlock()
-
-		time.Sleep(1 * time.Millisecond)
-	}
-}
-
-type deleteItem struct {
-	key    interface{}
-	expire time.Time
-}
-
-type deleteQueue []deleteItem
-
-func (dq deleteQueue) Len() int { return len(dq) }
+		close(e.done)
+
+		// Publish the result to the Cache and drop the in-flight entry
+		// under the same lock, so no Fetch/FetchContext call can land in
+		// a window where the key is in neither and triggers a duplicate
+		// upstream fetch.
+		c.mutex.Lock()
+		if e.err != nil {
+			// Don't reuse error values, unless the caller opted into
+			// memoizing this one.
+			if c.negativeTTL > 0 && (c.isCacheableErr == nil || c.isCacheableErr(e.err)) {
+				c.cache.Set(key, Entry{Err: e.err, Negative: true}, c.negativeTTL)
+			}
+		} else {
+			c.cache.Set(key, Entry{Value: e.value}, c.ttl)
+		}
+		delete(c.inflight, key)
+		c.mutex.Unlock()
+	}()
 
-func (dq deleteQueue) Less(i, j int) bool {
-	return dq[i].expire.Before(dq[j].expire)
+	return e
 }
 
-func (dq deleteQueue) Swap(i, j int) {
-	dq[i], dq[j] = dq[j], dq[i]
+// detach returns a context that carries ctx's values but is never Done and
+// never returns an error, so its cancellation can't be observed by code
+// that runs on behalf of more than just ctx's owner.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
 }
 
-func (dq *deleteQueue) Push(x interface{}) {
-	*dq = append(*dq, x.(deleteItem))
+type detachedContext struct {
+	context.Context
 }
 
-func (dq *deleteQueue) Pop() interface{} {
-	n := len(*dq)
-	ret := (*dq)[n-1]
-	*dq = (*dq)[0 : n-1]
-	return ret
-}
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,194 @@
+package fetchmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFetcher counts how many times Fetch actually ran upstream, and
+// blocks until release is closed so tests can control how long a fetch
+// stays in flight.
+type countingFetcher struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (f *countingFetcher) Fetch(key interface{}) (interface{}, error) {
+	atomic.AddInt32(&f.calls, 1)
+	<-f.release
+	return key, nil
+}
+
+// ctxCountingFetcher is countingFetcher's ContextFetcher counterpart: it
+// counts upstream calls the same way, but its Fetch takes a ctx so it
+// satisfies ContextFetcher instead of Fetcher.
+type ctxCountingFetcher struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (f *ctxCountingFetcher) Fetch(ctx context.Context, key interface{}) (interface{}, error) {
+	atomic.AddInt32(&f.calls, 1)
+	select {
+	case <-f.release:
+		return key, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TestFetchCoalescesConcurrentCallers guards against a regression where
+// publishing the result to the Cache and dropping the in-flight entry
+// happened as two separate critical sections: a Fetch landing in that gap
+// would see a miss in both and trigger a duplicate upstream fetch.
+func TestFetchCoalescesConcurrentCallers(t *testing.T) {
+	f := &countingFetcher{release: make(chan struct{})}
+	c := NewCachedFetcher(f, time.Minute, NewMemoryCache())
+
+	const n = 50
+	var wg sync.WaitGroup
+	results := make([]interface{}, n)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			v, err := c.Fetch("k")
+			if err != nil {
+				t.Errorf("Fetch: unexpected error: %v", err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	close(f.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&f.calls); calls != 1 {
+		t.Fatalf("Fetch called upstream %d times for one key, want 1", calls)
+	}
+	for i, v := range results {
+		if v != "k" {
+			t.Fatalf("results[%d] = %v, want %q", i, v, "k")
+		}
+	}
+
+	// A later call should be served from the cache, not trigger another
+	// upstream fetch.
+	if v, err := c.Fetch("k"); err != nil || v != "k" {
+		t.Fatalf("Fetch after completion = (%v, %v), want (%q, nil)", v, err, "k")
+	}
+	if calls := atomic.LoadInt32(&f.calls); calls != 1 {
+		t.Fatalf("Fetch called upstream %d times after caching, want 1", calls)
+	}
+}
+
+// TestFetchContextCancelDoesNotAffectOtherWaiters guards against a
+// regression where the upstream ContextFetcher.Fetch call was driven by a
+// single coalesced waiter's context: that waiter canceling (or timing out)
+// would abort the shared fetch and deliver ctx.Err() to every other
+// waiter, even ones whose own context never expired.
+func TestFetchContextCancelDoesNotAffectOtherWaiters(t *testing.T) {
+	f := &ctxCountingFetcher{release: make(chan struct{})}
+	c := NewCachedFetcherContext(f, time.Minute, NewMemoryCache())
+
+	cancelCtx, cancel := context.WithCancel(context.Background())
+
+	cancelDone := make(chan error, 1)
+	go func() {
+		_, err := c.FetchContext(cancelCtx, "k")
+		cancelDone <- err
+	}()
+
+	// Give the first caller time to start (and become) the in-flight
+	// fetch before canceling it.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-cancelDone:
+		if err != context.Canceled {
+			t.Fatalf("canceled caller got err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canceled caller never returned")
+	}
+
+	liveDone := make(chan struct {
+		v   interface{}
+		err error
+	}, 1)
+	go func() {
+		v, err := c.FetchContext(context.Background(), "k")
+		liveDone <- struct {
+			v   interface{}
+			err error
+		}{v, err}
+	}()
+
+	// The canceled waiter must not have aborted the shared upstream call.
+	select {
+	case <-liveDone:
+		t.Fatal("uncanceled caller returned before the upstream fetch was released")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(f.release)
+
+	select {
+	case res := <-liveDone:
+		if res.err != nil || res.v != "k" {
+			t.Fatalf("uncanceled caller got (%v, %v), want (%q, nil)", res.v, res.err, "k")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("uncanceled caller never returned")
+	}
+
+	if calls := atomic.LoadInt32(&f.calls); calls != 1 {
+		t.Fatalf("ctxFetcher.Fetch called %d times, want 1", calls)
+	}
+}
+
+// failingFetcher always fails, and counts how many times it was called.
+type failingFetcher struct {
+	calls int32
+	err   error
+}
+
+func (f *failingFetcher) Fetch(key interface{}) (interface{}, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return nil, f.err
+}
+
+// TestFetchMemoizesNegativeResultForTTL exercises Options.NegativeTTL: a
+// failed fetch should be memoized and returned to later callers without
+// hitting the upstream Fetcher again, until the negative entry expires.
+func TestFetchMemoizesNegativeResultForTTL(t *testing.T) {
+	wantErr := errors.New("upstream unavailable")
+	f := &failingFetcher{err: wantErr}
+	c := NewCachedFetcherWithOptions(f, time.Minute, NewMemoryCache(), Options{
+		NegativeTTL: 20 * time.Millisecond,
+	})
+
+	if _, err := c.Fetch("k"); err != wantErr {
+		t.Fatalf("Fetch() err = %v, want %v", err, wantErr)
+	}
+	if _, err := c.Fetch("k"); err != wantErr {
+		t.Fatalf("second Fetch() err = %v, want %v (served from the negative cache)", err, wantErr)
+	}
+	if calls := atomic.LoadInt32(&f.calls); calls != 1 {
+		t.Fatalf("Fetch called upstream %d times, want 1", calls)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if _, err := c.Fetch("k"); err != wantErr {
+		t.Fatalf("Fetch() after NegativeTTL err = %v, want %v", err, wantErr)
+	}
+	if calls := atomic.LoadInt32(&f.calls); calls != 2 {
+		t.Fatalf("Fetch called upstream %d times after the negative entry expired, want 2", calls)
+	}
+}
@@ -1,6 +1,7 @@
 package fetchmgr
 
 import (
+	"context"
 	"io"
 	"sync"
 )
@@ -36,4 +37,32 @@ type SafeFetchCloser struct {
 func NewSafeFetchCloser(fc FetchCloser) FetchCloser {
 	sf := NewSafeFetcher(fc)
 	return SafeFetchCloser{sf, fc}
-}
\ No newline at end of file
+}
+
+// ContextFetcher is like Fetcher, but its Fetch accepts a context.Context, so that
+// callers can cancel a fetch or bound it with a deadline. Implementations
+// should stop work and return ctx.Err() (or a wrapped form of it) once ctx
+// is done, but are not required to do so immediately.
+type ContextFetcher interface {
+	Fetch(ctx context.Context, key interface{}) (interface{}, error)
+}
+
+// SafeContextFetcher is a synced instance of ContextFetcher
+type SafeContextFetcher struct {
+	mutex   *sync.Mutex
+	fetcher ContextFetcher
+}
+
+// NewSafeContextFetcher makes f thread-safe. It will be a slow instance
+// because all Fetch() calls are serialized.
+func NewSafeContextFetcher(f ContextFetcher) ContextFetcher {
+	var mutex sync.Mutex
+	return SafeContextFetcher{&mutex, f}
+}
+
+// Fetch fetches a value
+func (sf SafeContextFetcher) Fetch(ctx context.Context, k interface{}) (interface{}, error) {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	return sf.fetcher.Fetch(ctx, k)
+}